@@ -0,0 +1,428 @@
+// Package aufs is a AUFS graphdriver for docker.
+//
+// This version of the driver is stripped down to a minimum, as it is
+// primarily used as a reference for new driver development. It is not
+// recommended that it be used as the primary driver in production use due to
+// some of the inherent limitations with AUFS that will not be resolved.
+package aufs
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"sync"
+
+	"github.com/docker/docker/daemon/graphdriver"
+	"github.com/docker/docker/pkg/idtools"
+	"github.com/opencontainers/selinux/go-selinux/label"
+)
+
+var (
+	// ErrAufsNotSupported is returned if aufs is not supported by the host.
+	ErrAufsNotSupported = fmt.Errorf("AUFS was not found in /proc/filesystems")
+)
+
+func init() {
+	graphdriver.Register("aufs", Init)
+}
+
+// AufsDriver is a graphdriver.Driver backed by aufs unions.
+type AufsDriver struct {
+	sync.Mutex
+	root    string
+	active  map[string]int
+	uidMaps []idtools.IDMap
+	gidMaps []idtools.IDMap
+	rootUID int
+	rootGID int
+	caps    aufsCapabilities
+}
+
+// Init returns a new AUFS driver, rooted at the given path. It creates the
+// required directory structure under root if it does not already exist.
+// When uidMaps/gidMaps describe a user namespace, the mnt/diff/layers
+// subdirectories it creates are chowned to that namespace's remapped root
+// so that containers running inside it see a rootfs they own.
+//
+// Init also probes and caches the running kernel's aufs capabilities,
+// failing with ErrAufsNotSupported or ErrAufsNested if aufs cannot be
+// used at all here, and seeds the project-id allocator used for quota
+// enforcement past every id already recorded under layers/ so that a
+// restart never reassigns one to a different layer.
+func Init(root string, options []string, uidMaps, gidMaps []idtools.IDMap) (graphdriver.Driver, error) {
+	caps, err := probeCapabilities(root)
+	if err != nil {
+		return nil, err
+	}
+
+	rootUID, rootGID, err := idtools.GetRootUIDGID(uidMaps, gidMaps)
+	if err != nil {
+		return nil, err
+	}
+
+	a := &AufsDriver{
+		root:    root,
+		active:  make(map[string]int),
+		uidMaps: uidMaps,
+		gidMaps: gidMaps,
+		rootUID: rootUID,
+		rootGID: rootGID,
+		caps:    caps,
+	}
+
+	rootPath := a.rootPath()
+	for _, p := range []string{"mnt", "diff", "layers"} {
+		if err := idtools.MkdirAllAs(path.Join(rootPath, p), 0755, rootUID, rootGID); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := seedProjectIDs(path.Join(rootPath, "layers")); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func (a *AufsDriver) rootPath() string {
+	return path.Join(a.root, "aufs")
+}
+
+func (a *AufsDriver) String() string {
+	return "aufs"
+}
+
+// CreateOpts holds a layer's SELinux mount label. None of this driver's
+// methods take it: CreateWithLabel accepts the label as a plain string.
+type CreateOpts struct {
+	// MountLabel is the SELinux label applied to the aufs mount.
+	MountLabel string
+}
+
+// Create creates a new layer with the given id on top of parent, which may
+// be the empty string for a base layer. opts may carry a "size" StorageOpt,
+// enforced as a hard disk-usage limit on the layer's diff directory via
+// project quotas; it is nil or empty for layers with no such limit.
+func (a *AufsDriver) Create(id, parent string, opts map[string]string) error {
+	return a.create(id, parent, "", opts)
+}
+
+// CreateWithLabel creates a new layer with the given id on top of parent,
+// recording mountLabel so that it is applied whenever the layer is mounted.
+func (a *AufsDriver) CreateWithLabel(id, parent, mountLabel string) error {
+	return a.create(id, parent, mountLabel, nil)
+}
+
+func (a *AufsDriver) create(id, parent, mountLabel string, opts map[string]string) error {
+	if err := a.createDirsFor(id); err != nil {
+		return err
+	}
+
+	if err := a.setParent(id, parent); err != nil {
+		return err
+	}
+
+	if err := a.setMountLabel(id, mountLabel); err != nil {
+		return err
+	}
+
+	projectID, err := a.applyStorageOpt(path.Join(a.rootPath(), "diff", id), opts)
+	if err != nil {
+		return err
+	}
+	return a.setProjectID(id, projectID)
+}
+
+func (a *AufsDriver) createDirsFor(id string) error {
+	for _, p := range []string{"mnt", "diff"} {
+		if err := idtools.MkdirAllAs(path.Join(a.rootPath(), p, id), 0755, a.rootUID, a.rootGID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setParent records parent as id's nearest ancestor, by writing out
+// parent's own parent chain prefixed with parent itself; id's "layers" file is created
+// empty for a base layer with no parent.
+func (a *AufsDriver) setParent(id, parent string) error {
+	layersFile := path.Join(a.rootPath(), "layers", id)
+	f, err := os.Create(layersFile)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := os.Chown(layersFile, a.rootUID, a.rootGID); err != nil {
+		return err
+	}
+
+	if parent == "" {
+		return nil
+	}
+	if !a.Exists(parent) {
+		return fmt.Errorf("%s: parent %s does not exist", id, parent)
+	}
+
+	ids, err := getParentIds(a.rootPath(), parent)
+	if err != nil {
+		return err
+	}
+	ids = append([]string{parent}, ids...)
+
+	for _, i := range ids {
+		if _, err := fmt.Fprintln(f, i); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setMountLabel persists mountLabel alongside the rest of the layer
+// metadata so that it can be recovered across driver restarts.
+func (a *AufsDriver) setMountLabel(id, mountLabel string) error {
+	if mountLabel == "" {
+		return nil
+	}
+	return os.WriteFile(path.Join(a.rootPath(), "layers", id+"-mountlabel"), []byte(mountLabel), 0644)
+}
+
+func (a *AufsDriver) getMountLabel(id string) (string, error) {
+	mountLabel, err := os.ReadFile(path.Join(a.rootPath(), "layers", id+"-mountlabel"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", nil
+		}
+		return "", err
+	}
+	return string(mountLabel), nil
+}
+
+// setProjectID persists the project id allocated to id's quota, if any,
+// alongside the rest of the layer's metadata so it can be released again
+// on Remove. A zero projectID means no quota was requested.
+func (a *AufsDriver) setProjectID(id string, projectID uint32) error {
+	if projectID == 0 {
+		return nil
+	}
+	return os.WriteFile(path.Join(a.rootPath(), "layers", id+"-quota"), []byte(fmt.Sprintf("%d", projectID)), 0644)
+}
+
+func (a *AufsDriver) getProjectID(id string) (uint32, error) {
+	data, err := os.ReadFile(path.Join(a.rootPath(), "layers", id+"-quota"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	var projectID uint32
+	if _, err := fmt.Sscanf(string(data), "%d", &projectID); err != nil {
+		return 0, err
+	}
+	return projectID, nil
+}
+
+// Remove deletes all traces of the given layer.
+func (a *AufsDriver) Remove(id string) error {
+	if !a.Exists(id) {
+		return fmt.Errorf("Layer %s does not exist", id)
+	}
+
+	if err := a.unmount(id); err != nil {
+		return err
+	}
+
+	if projectID, err := a.getProjectID(id); err != nil {
+		return err
+	} else if projectID != 0 {
+		if err := releaseProjectQuota(path.Join(a.rootPath(), "diff", id), projectID); err != nil {
+			return err
+		}
+	}
+
+	for _, p := range []string{"mnt", "diff", "layers"} {
+		dir := path.Join(a.rootPath(), p, id)
+		// dir may be owned by the remapped root of a user namespace
+		// rather than our own uid/gid; relax its mode first so that
+		// RemoveAll can still recurse into and unlink it.
+		if err := os.Chmod(dir, 0700); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if err := os.RemoveAll(dir); err != nil {
+			return err
+		}
+	}
+	if err := os.RemoveAll(path.Join(a.rootPath(), "layers", id+"-quota")); err != nil {
+		return err
+	}
+	if err := os.RemoveAll(a.tarSplitPath(id)); err != nil {
+		return err
+	}
+	return os.RemoveAll(path.Join(a.rootPath(), "layers", id+"-mountlabel"))
+}
+
+// Get returns a ContainerFS handle onto the rootfs for id, mounting the
+// aufs union of id and its parents if it has any. The returned handle
+// wraps a local path for this driver, but callers should prefer its
+// Open/Stat/ReadDir/etc. methods over Path() so that they keep working
+// against graphdrivers backed by a non-local rootfs. Each call increments
+// id's reference count in active; callers must balance it with a
+// matching Put.
+func (a *AufsDriver) Get(id string) (ContainerFS, error) {
+	parents, err := getParentIds(a.rootPath(), id)
+	if err != nil {
+		return nil, err
+	}
+
+	a.Lock()
+	defer a.Unlock()
+
+	if len(parents) == 0 {
+		a.active[id]++
+		return newLocalContainerFS(path.Join(a.rootPath(), "diff", id)), nil
+	}
+
+	if a.active[id] == 0 {
+		mountLabel, err := a.getMountLabel(id)
+		if err != nil {
+			return nil, err
+		}
+		if err := a.mount(id, mountLabel); err != nil {
+			return nil, err
+		}
+	}
+	a.active[id]++
+	return newLocalContainerFS(path.Join(a.rootPath(), "mnt", id)), nil
+}
+
+// Put releases a reference to id acquired via Get, unmounting its aufs
+// union once the reference count drops to zero.
+func (a *AufsDriver) Put(id string) error {
+	a.Lock()
+	defer a.Unlock()
+
+	if count := a.active[id]; count > 1 {
+		a.active[id] = count - 1
+		return nil
+	}
+	delete(a.active, id)
+	return a.unmount(id)
+}
+
+// Exists returns whether a layer with the given id has been created.
+func (a *AufsDriver) Exists(id string) bool {
+	_, err := os.Stat(path.Join(a.rootPath(), "layers", id))
+	return err == nil || id == ""
+}
+
+// Cleanup unmounts every layer that is currently mounted.
+func (a *AufsDriver) Cleanup() error {
+	dir, err := os.ReadDir(path.Join(a.rootPath(), "mnt"))
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range dir {
+		if mounted, err := a.mounted(entry.Name()); err != nil {
+			return err
+		} else if mounted {
+			if err := a.unmount(entry.Name()); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (a *AufsDriver) mounted(id string) (bool, error) {
+	mntPath := path.Join(a.rootPath(), "mnt", id)
+	return graphdriver.Mounted(mntPath)
+}
+
+// mount mounts the aufs union for id, applying mountLabel via the SELinux
+// context=/rootcontext= mount options so the union is usable from an
+// SELinux-confined container process.
+func (a *AufsDriver) mount(id, mountLabel string) error {
+	if mounted, err := a.mounted(id); err != nil {
+		return err
+	} else if mounted {
+		return nil
+	}
+
+	mntPath := path.Join(a.rootPath(), "mnt", id)
+	opts, err := a.aufsMountOptions(id, mountLabel)
+	if err != nil {
+		return err
+	}
+
+	return exec.Command("mount", "-t", "aufs", "-o", opts, "none", mntPath).Run()
+}
+
+func (a *AufsDriver) unmount(id string) error {
+	if mounted, err := a.mounted(id); err != nil {
+		return err
+	} else if !mounted {
+		return nil
+	}
+	return exec.Command("umount", path.Join(a.rootPath(), "mnt", id)).Run()
+}
+
+// aufsMountOptions builds the "-o" argument for an aufs mount of id over its
+// parents, branch-by-branch from newest to oldest, and appends the SELinux
+// context derived from mountLabel when one was recorded for the layer.
+func (a *AufsDriver) aufsMountOptions(id, mountLabel string) (string, error) {
+	parents, err := getParentIds(a.rootPath(), id)
+	if err != nil {
+		return "", err
+	}
+
+	if n := len(parents) + 1; n > a.MaxBranches() {
+		return "", fmt.Errorf("%s: %d branches exceeds this kernel's aufs limit of %d", id, n, a.MaxBranches())
+	}
+
+	branches := make([]string, 0, len(parents)+1)
+	branches = append(branches, fmt.Sprintf("br:%s=rw", path.Join(a.rootPath(), "diff", id)))
+	for _, p := range parents {
+		branches = append(branches, fmt.Sprintf("%s=ro+wh", path.Join(a.rootPath(), "diff", p)))
+	}
+
+	data := joinBranches(branches)
+	if a.caps.dirperm1 {
+		data += ",dirperm1"
+	}
+	if mountLabel != "" {
+		data = label.FormatMountLabel(data, mountLabel)
+	}
+	return data, nil
+}
+
+func joinBranches(branches []string) string {
+	out := branches[0]
+	for _, b := range branches[1:] {
+		out += ":" + b
+	}
+	return out
+}
+
+// getParentIds reads the "layers" metadata file for id and returns the ids
+// of its parent layers, ordered from nearest to furthest ancestor.
+func getParentIds(root, id string) ([]string, error) {
+	f, err := os.Open(path.Join(root, "layers", id))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+
+	var out []string
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		if line := s.Text(); line != "" {
+			out = append(out, line)
+		}
+	}
+	return out, s.Err()
+}
@@ -1,25 +1,43 @@
 package aufs
 
 import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"io"
 	"os"
 	"path"
+	"strings"
+	"syscall"
 	"testing"
+
+	"github.com/docker/docker/daemon/graphdriver"
+	"github.com/docker/docker/pkg/idtools"
 )
 
 var (
 	tmp = path.Join(os.TempDir(), "aufs-tests")
 )
 
-func newDriver(t *testing.T) *AufsDriver {
-	if err := os.MkdirAll(tmp, 0755); err != nil {
+// testInit wraps Init, skipping the test instead of failing it when this
+// kernel doesn't support aufs at all.
+func testInit(root string, t *testing.T) graphdriver.Driver {
+	d, err := Init(root, nil, nil, nil)
+	if err != nil {
+		if err == ErrAufsNotSupported || err == ErrAufsNested {
+			t.Skipf("aufs not supported here: %v", err)
+		}
 		t.Fatal(err)
 	}
+	return d
+}
 
-	d, err := Init(tmp)
-	if err != nil {
+func newDriver(t *testing.T) *AufsDriver {
+	if err := os.MkdirAll(tmp, 0755); err != nil {
 		t.Fatal(err)
 	}
-	return d.(*AufsDriver)
+
+	return testInit(tmp, t).(*AufsDriver)
 }
 
 func TestNewAufsDriver(t *testing.T) {
@@ -27,10 +45,7 @@ func TestNewAufsDriver(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	d, err := Init(tmp)
-	if err != nil {
-		t.Fatal(err)
-	}
+	d := testInit(tmp, t)
 	defer os.RemoveAll(tmp)
 	if d == nil {
 		t.Fatalf("Driver should not be nil")
@@ -69,12 +84,8 @@ func TestNewDriverFromExistingDir(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	if _, err := Init(tmp); err != nil {
-		t.Fatal(err)
-	}
-	if _, err := Init(tmp); err != nil {
-		t.Fatal(err)
-	}
+	testInit(tmp, t)
+	testInit(tmp, t)
 	os.RemoveAll(tmp)
 }
 
@@ -82,7 +93,7 @@ func TestCreateNewDir(t *testing.T) {
 	d := newDriver(t)
 	defer os.RemoveAll(tmp)
 
-	if err := d.Create("1", ""); err != nil {
+	if err := d.Create("1", "", nil); err != nil {
 		t.Fatal(err)
 	}
 }
@@ -91,7 +102,7 @@ func TestCreateNewDirStructure(t *testing.T) {
 	d := newDriver(t)
 	defer os.RemoveAll(tmp)
 
-	if err := d.Create("1", ""); err != nil {
+	if err := d.Create("1", "", nil); err != nil {
 		t.Fatal(err)
 	}
 
@@ -108,11 +119,54 @@ func TestCreateNewDirStructure(t *testing.T) {
 	}
 }
 
+func TestCreateNewDirStructureWithIDMaps(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("requires root to remap ownership")
+	}
+	if err := os.MkdirAll(tmp, 0755); err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	uidMaps := []idtools.IDMap{{ContainerID: 0, HostID: 42, Size: 1}}
+	gidMaps := []idtools.IDMap{{ContainerID: 0, HostID: 43, Size: 1}}
+
+	dr, err := Init(tmp, nil, uidMaps, gidMaps)
+	if err != nil {
+		if err == ErrAufsNotSupported || err == ErrAufsNested {
+			t.Skipf("aufs not supported here: %v", err)
+		}
+		t.Fatal(err)
+	}
+	d := dr.(*AufsDriver)
+
+	if err := d.Create("1", "", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	paths := []string{
+		"mnt",
+		"diff",
+		"layers",
+	}
+
+	for _, p := range paths {
+		info, err := os.Stat(path.Join(tmp, "aufs", p, "1"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		stat := info.Sys().(*syscall.Stat_t)
+		if int(stat.Uid) != 42 || int(stat.Gid) != 43 {
+			t.Fatalf("%s: expected owner 42:43 got %d:%d", p, stat.Uid, stat.Gid)
+		}
+	}
+}
+
 func TestRemoveImage(t *testing.T) {
 	d := newDriver(t)
 	defer os.RemoveAll(tmp)
 
-	if err := d.Create("1", ""); err != nil {
+	if err := d.Create("1", "", nil); err != nil {
 		t.Fatal(err)
 	}
 
@@ -137,17 +191,77 @@ func TestGetWithoutParent(t *testing.T) {
 	d := newDriver(t)
 	defer os.RemoveAll(tmp)
 
-	if err := d.Create("1", ""); err != nil {
+	if err := d.Create("1", "", nil); err != nil {
 		t.Fatal(err)
 	}
 
-	diffPath, err := d.Get("1")
+	mnt, err := d.Get("1")
 	if err != nil {
 		t.Fatal(err)
 	}
 	expected := path.Join(tmp, "aufs", "diff", "1")
-	if diffPath != expected {
-		t.Fatalf("Expected path %s got %s", expected, diffPath)
+	if mnt.Path() != expected {
+		t.Fatalf("Expected path %s got %s", expected, mnt.Path())
+	}
+}
+
+func TestGetOpensAndStatsFiles(t *testing.T) {
+	d := newDriver(t)
+	defer os.RemoveAll(tmp)
+
+	if err := d.Create("1", "", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	mnt, err := d.Get("1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	contents := []byte("hello world")
+	if err := os.WriteFile(path.Join(mnt.Path(), "greeting"), contents, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		size func() (int64, error)
+	}{
+		{
+			name: "Stat",
+			size: func() (int64, error) {
+				info, err := mnt.Stat("greeting")
+				if err != nil {
+					return 0, err
+				}
+				return info.Size(), nil
+			},
+		},
+		{
+			name: "Open",
+			size: func() (int64, error) {
+				f, err := mnt.Open("greeting")
+				if err != nil {
+					return 0, err
+				}
+				defer f.Close()
+				info, err := f.Stat()
+				if err != nil {
+					return 0, err
+				}
+				return info.Size(), nil
+			},
+		},
+	}
+
+	for _, tc := range tests {
+		size, err := tc.size()
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if size != int64(len(contents)) {
+			t.Fatalf("%s: expected size %d got %d", tc.name, len(contents), size)
+		}
 	}
 }
 
@@ -164,7 +278,7 @@ func TestCleanupWithDir(t *testing.T) {
 	d := newDriver(t)
 	defer os.RemoveAll(tmp)
 
-	if err := d.Create("1", ""); err != nil {
+	if err := d.Create("1", "", nil); err != nil {
 		t.Fatal(err)
 	}
 
@@ -177,7 +291,7 @@ func TestMountedFalseResponse(t *testing.T) {
 	d := newDriver(t)
 	defer os.RemoveAll(tmp)
 
-	if err := d.Create("1", ""); err != nil {
+	if err := d.Create("1", "", nil); err != nil {
 		t.Fatal(err)
 	}
 
@@ -196,10 +310,10 @@ func TestMountedTrueReponse(t *testing.T) {
 	defer os.RemoveAll(tmp)
 	defer d.Cleanup()
 
-	if err := d.Create("1", ""); err != nil {
+	if err := d.Create("1", "", nil); err != nil {
 		t.Fatal(err)
 	}
-	if err := d.Create("2", "1"); err != nil {
+	if err := d.Create("2", "1", nil); err != nil {
 		t.Fatal(err)
 	}
 
@@ -222,24 +336,24 @@ func TestMountWithParent(t *testing.T) {
 	d := newDriver(t)
 	defer os.RemoveAll(tmp)
 
-	if err := d.Create("1", ""); err != nil {
+	if err := d.Create("1", "", nil); err != nil {
 		t.Fatal(err)
 	}
-	if err := d.Create("2", "1"); err != nil {
+	if err := d.Create("2", "1", nil); err != nil {
 		t.Fatal(err)
 	}
 
-	mntPath, err := d.Get("2")
+	mnt, err := d.Get("2")
 	if err != nil {
 		t.Fatal(err)
 	}
-	if mntPath == "" {
-		t.Fatal("mntPath should not be empty string")
+	if mnt.Path() == "" {
+		t.Fatal("mnt.Path() should not be empty string")
 	}
 
 	expected := path.Join(tmp, "aufs", "mnt", "2")
-	if mntPath != expected {
-		t.Fatalf("Expected %s got %s", expected, mntPath)
+	if mnt.Path() != expected {
+		t.Fatalf("Expected %s got %s", expected, mnt.Path())
 	}
 
 	if err := d.Cleanup(); err != nil {
@@ -247,11 +361,64 @@ func TestMountWithParent(t *testing.T) {
 	}
 }
 
+func TestCreateNewDirWithLabel(t *testing.T) {
+	d := newDriver(t)
+	defer os.RemoveAll(tmp)
+
+	mountLabel := "system_u:object_r:svirt_sandbox_file_t:s0:c1,c2"
+	if err := d.CreateWithLabel("1", "", mountLabel); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := d.getMountLabel("1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != mountLabel {
+		t.Fatalf("Expected mount label %q got %q", mountLabel, got)
+	}
+}
+
+func TestMountWithLabel(t *testing.T) {
+	d := newDriver(t)
+	defer os.RemoveAll(tmp)
+	defer d.Cleanup()
+
+	mountLabel := "system_u:object_r:svirt_sandbox_file_t:s0:c1,c2"
+	if err := d.CreateWithLabel("1", "", mountLabel); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Create("2", "1", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	opts, err := d.aufsMountOptions("1", mountLabel)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(opts, "context=") {
+		t.Fatalf("Expected mount options to carry an SELinux context, got %q", opts)
+	}
+}
+
+func TestCreateWithSizeOnUnsupportedFs(t *testing.T) {
+	d := newDriver(t)
+	defer os.RemoveAll(tmp)
+
+	// tmp is a plain directory, not an xfs/ext4 mount with project
+	// quotas enabled, so asking for a size limit must fail clearly
+	// instead of silently creating an unbounded layer.
+	err := d.Create("1", "", map[string]string{"size": "1048576"})
+	if err == nil {
+		t.Fatal("Expected an error requesting a storage-opt size on a filesystem without project quota support")
+	}
+}
+
 func TestCreateWithInvalidParent(t *testing.T) {
 	d := newDriver(t)
 	defer os.RemoveAll(tmp)
 
-	if err := d.Create("1", "docker"); err == nil {
+	if err := d.Create("1", "docker", nil); err == nil {
 		t.Fatalf("Error should not be nil with parent does not exist")
 	}
 }
@@ -260,11 +427,11 @@ func TestGetDiff(t *testing.T) {
 	d := newDriver(t)
 	defer os.RemoveAll(tmp)
 
-	if err := d.Create("1", ""); err != nil {
+	if err := d.Create("1", "", nil); err != nil {
 		t.Fatal(err)
 	}
 
-	diffPath, err := d.Get("1")
+	mnt, err := d.Get("1")
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -272,7 +439,7 @@ func TestGetDiff(t *testing.T) {
 	// Add a file to the diff path with a fixed size
 	size := int64(1024)
 
-	f, err := os.Create(path.Join(diffPath, "test_file"))
+	f, err := os.Create(path.Join(mnt.Path(), "test_file"))
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -290,34 +457,83 @@ func TestGetDiff(t *testing.T) {
 	}
 }
 
-/* FIXME: How to properly test this?
-func TestDiffSize(t *testing.T) {
+// TestGetDiffIsByteReproducible applies a known tarball via ApplyDiff and
+// checks that re-diffing the layer reproduces the exact same bytes,
+// rather than a re-derived tar that merely contains the same files.
+func TestGetDiffIsByteReproducible(t *testing.T) {
 	d := newDriver(t)
 	defer os.RemoveAll(tmp)
 
-	if err := d.Create("1", ""); err != nil {
+	if err := d.Create("1", "", nil); err != nil {
 		t.Fatal(err)
 	}
 
-	diffPath, err := d.Get("1")
-	if err != nil {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	contents := []byte("hello from a known tarball")
+	if err := tw.WriteHeader(&tar.Header{
+		Name: "greeting",
+		Mode: 0644,
+		Size: int64(len(contents)),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tw.Write(contents); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
 		t.Fatal(err)
 	}
+	original := buf.Bytes()
 
-	// Add a file to the diff path with a fixed size
-	size := int64(1024)
+	if _, err := d.ApplyDiff("1", bytes.NewReader(original)); err != nil {
+		t.Fatal(err)
+	}
 
-	f, err := os.Create(path.Join(diffPath, "test_file"))
+	archive, err := d.Diff("1")
 	if err != nil {
 		t.Fatal(err)
 	}
-	f.Truncate(size)
-	s, err := f.Stat()
+	defer archive.Close()
+
+	replayed, err := io.ReadAll(archive)
 	if err != nil {
 		t.Fatal(err)
 	}
-	size = s.Size()
-	if err := f.Close(); err != nil {
+
+	wantSum := sha256.Sum256(original)
+	gotSum := sha256.Sum256(replayed)
+	if wantSum != gotSum {
+		t.Fatalf("Expected re-diffed tar to be byte-identical to the applied tar, sha256 mismatch (want %x got %x)", wantSum, gotSum)
+	}
+}
+
+func TestDiffSize(t *testing.T) {
+	d := newDriver(t)
+	defer os.RemoveAll(tmp)
+
+	if err := d.Create("1", "", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	contents := []byte("hello from a known tarball")
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	if err := tw.WriteHeader(&tar.Header{
+		Name: "greeting",
+		Mode: 0644,
+		Size: int64(len(contents)),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tw.Write(contents); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := d.ApplyDiff("1", bytes.NewReader(buf.Bytes())); err != nil {
 		t.Fatal(err)
 	}
 
@@ -325,8 +541,7 @@ func TestDiffSize(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	if diffSize != size {
-		t.Fatalf("Expected size to be %d got %d", size, diffSize)
+	if diffSize != int64(len(contents)) {
+		t.Fatalf("Expected size to be %d got %d", len(contents), diffSize)
 	}
 }
-*/
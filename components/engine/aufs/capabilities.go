@@ -0,0 +1,149 @@
+package aufs
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var (
+	// ErrAufsNested is returned if aufs is probed from inside a
+	// non-init user namespace, where aufs mounts are not available.
+	ErrAufsNested = fmt.Errorf("aufs is not supported inside a non-init user namespace")
+
+	capsOnce sync.Once
+	caps     aufsCapabilities
+	capsErr  error
+)
+
+// defaultMaxBranches is used when the kernel's configured branch limit
+// cannot be determined, matching aufs' own compiled-in default.
+const defaultMaxBranches = 42
+
+// aufsCapabilities records the aufs features available on the running
+// kernel, probed once per process and reused for every driver instance.
+type aufsCapabilities struct {
+	// dirperm1 is true if the kernel accepts the dirperm1 mount option,
+	// which should then be added to every real mount to avoid the
+	// well known dirperm permission-propagation bug.
+	dirperm1 bool
+	// maxBranches is the largest number of branches a single aufs mount
+	// on this kernel will accept.
+	maxBranches int
+}
+
+// probeCapabilities detects whether aufs is usable at all, and if so
+// caches its dirperm1 and max-branches capabilities. It is safe to call
+// from multiple driver instances; the actual probing only ever runs once.
+func probeCapabilities(root string) (aufsCapabilities, error) {
+	capsOnce.Do(func() {
+		capsErr = checkProcFilesystems("/proc/filesystems")
+		if capsErr != nil {
+			return
+		}
+		capsErr = checkUserNamespace()
+		if capsErr != nil {
+			return
+		}
+		caps = aufsCapabilities{
+			dirperm1:    probeDirperm1(root),
+			maxBranches: probeMaxBranches(),
+		}
+	})
+	return caps, capsErr
+}
+
+// checkProcFilesystems returns ErrAufsNotSupported unless aufs is listed
+// as a registered filesystem in the given /proc/filesystems-style file.
+func checkProcFilesystems(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) > 0 && fields[len(fields)-1] == "aufs" {
+			return nil
+		}
+	}
+	if err := s.Err(); err != nil {
+		return err
+	}
+	return ErrAufsNotSupported
+}
+
+// checkUserNamespace refuses to initialize aufs when the calling process
+// is confined to a non-init user namespace, where mount(2) for aufs is
+// rejected by the kernel regardless of capabilities.
+func checkUserNamespace() error {
+	self, err := os.Readlink("/proc/self/ns/user")
+	if err != nil {
+		// Kernels without user namespace support have no ns/user
+		// link at all; there is nothing nested to refuse.
+		return nil
+	}
+	init, err := os.Readlink("/proc/1/ns/user")
+	if err != nil {
+		return nil
+	}
+	if self != init {
+		return ErrAufsNested
+	}
+	return nil
+}
+
+// probeDirperm1 performs a throwaway aufs mount of two empty directories
+// under root with the dirperm1 option, and reports whether the kernel
+// accepted it. Real mounts should only pass dirperm1 when this is true.
+func probeDirperm1(root string) bool {
+	base, err := os.MkdirTemp(root, "dirperm1-probe-")
+	if err != nil {
+		return false
+	}
+	defer os.RemoveAll(base)
+
+	rw := path.Join(base, "rw")
+	mnt := path.Join(base, "mnt")
+	if err := os.MkdirAll(rw, 0755); err != nil {
+		return false
+	}
+	if err := os.MkdirAll(mnt, 0755); err != nil {
+		return false
+	}
+
+	opts := fmt.Sprintf("br:%s,dirperm1", rw)
+	if err := exec.Command("mount", "-t", "aufs", "-o", opts, "none", mnt).Run(); err != nil {
+		return false
+	}
+	exec.Command("umount", mnt).Run()
+	return true
+}
+
+// probeMaxBranches determines the per-mount branch limit this kernel's
+// aufs was compiled with, preferring the value it exposes directly and
+// otherwise falling back to the documented default.
+func probeMaxBranches() int {
+	data, err := os.ReadFile("/sys/fs/aufs/config/brs")
+	if err != nil {
+		return defaultMaxBranches
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil || n <= 0 {
+		return defaultMaxBranches
+	}
+	return n
+}
+
+// MaxBranches returns the largest number of branches a single aufs mount
+// will accept on this kernel.
+func (a *AufsDriver) MaxBranches() int {
+	return a.caps.maxBranches
+}
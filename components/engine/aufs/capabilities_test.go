@@ -0,0 +1,36 @@
+package aufs
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeFakeProcFilesystems(t *testing.T, contents string) string {
+	dir := t.TempDir()
+	p := filepath.Join(dir, "filesystems")
+	if err := os.WriteFile(p, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestCheckProcFilesystemsWithAufs(t *testing.T) {
+	p := writeFakeProcFilesystems(t, "nodev\tsysfs\nnodev\ttmpfs\n\taufs\n\text4\n")
+	if err := checkProcFilesystems(p); err != nil {
+		t.Fatalf("Expected aufs to be recognized as supported, got %v", err)
+	}
+}
+
+func TestCheckProcFilesystemsWithoutAufs(t *testing.T) {
+	p := writeFakeProcFilesystems(t, "nodev\tsysfs\nnodev\ttmpfs\n\text4\n")
+	if err := checkProcFilesystems(p); err != ErrAufsNotSupported {
+		t.Fatalf("Expected ErrAufsNotSupported, got %v", err)
+	}
+}
+
+func TestCheckProcFilesystemsMissingFile(t *testing.T) {
+	if err := checkProcFilesystems(filepath.Join(t.TempDir(), "does-not-exist")); err == nil {
+		t.Fatal("Expected an error reading a missing /proc/filesystems")
+	}
+}
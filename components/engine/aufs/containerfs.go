@@ -0,0 +1,91 @@
+package aufs
+
+import (
+	"io"
+	"os"
+	"path"
+
+	"github.com/docker/docker/pkg/archive"
+)
+
+// ContainerFS is a handle onto a container's rootfs. It is returned by
+// Get in place of a bare path so that callers such as `docker cp` and
+// ADD/COPY during build do not need to assume the rootfs is a directory
+// that is directly accessible on the host: other graphdrivers may back it
+// with a remote or virtualized filesystem (LCOW-style guest-hosted
+// filesystems, remote FUSE mounts, and so on).
+type ContainerFS interface {
+	// Path returns the local path of the rootfs, for drivers that have
+	// one. Callers that can operate through the rest of this interface
+	// should prefer to do so instead of assuming Path is usable.
+	Path() string
+
+	Open(path string) (*os.File, error)
+	Stat(path string) (os.FileInfo, error)
+	Lstat(path string) (os.FileInfo, error)
+	ReadDir(path string) ([]os.FileInfo, error)
+	Mkdir(path string, perm os.FileMode) error
+
+	// ExtractArchive extracts the given tar stream into path.
+	ExtractArchive(src io.Reader, path string, opts *archive.TarOptions) error
+	// ArchivePath tars up path and returns it as a stream.
+	ArchivePath(path string, opts *archive.TarOptions) (io.ReadCloser, error)
+}
+
+// localContainerFS is the default ContainerFS implementation used by
+// AufsDriver. It simply operates on a local directory on the host.
+type localContainerFS struct {
+	path string
+}
+
+func newLocalContainerFS(path string) ContainerFS {
+	return &localContainerFS{path: path}
+}
+
+func (l *localContainerFS) Path() string {
+	return l.path
+}
+
+func (l *localContainerFS) resolve(p string) string {
+	return path.Join(l.path, p)
+}
+
+func (l *localContainerFS) Open(p string) (*os.File, error) {
+	return os.Open(l.resolve(p))
+}
+
+func (l *localContainerFS) Stat(p string) (os.FileInfo, error) {
+	return os.Stat(l.resolve(p))
+}
+
+func (l *localContainerFS) Lstat(p string) (os.FileInfo, error) {
+	return os.Lstat(l.resolve(p))
+}
+
+func (l *localContainerFS) ReadDir(p string) ([]os.FileInfo, error) {
+	entries, err := os.ReadDir(l.resolve(p))
+	if err != nil {
+		return nil, err
+	}
+	infos := make([]os.FileInfo, 0, len(entries))
+	for _, e := range entries {
+		info, err := e.Info()
+		if err != nil {
+			return nil, err
+		}
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+func (l *localContainerFS) Mkdir(p string, perm os.FileMode) error {
+	return os.Mkdir(l.resolve(p), perm)
+}
+
+func (l *localContainerFS) ExtractArchive(src io.Reader, p string, opts *archive.TarOptions) error {
+	return archive.Untar(src, l.resolve(p), opts)
+}
+
+func (l *localContainerFS) ArchivePath(p string, opts *archive.TarOptions) (io.ReadCloser, error) {
+	return archive.TarWithOptions(l.resolve(p), opts)
+}
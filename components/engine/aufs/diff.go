@@ -0,0 +1,123 @@
+package aufs
+
+import (
+	"compress/gzip"
+	"io"
+	"os"
+	"path"
+
+	"github.com/docker/docker/pkg/archive"
+	"github.com/vbatts/tar-split/tar/asm"
+	"github.com/vbatts/tar-split/tar/storage"
+)
+
+// tarSplitPath returns where the tar-split metadata for id's diff is kept,
+// alongside the rest of that layer's metadata.
+func (a *AufsDriver) tarSplitPath(id string) string {
+	return path.Join(a.rootPath(), "layers", id+"-tar-split.json.gz")
+}
+
+// ApplyDiff extracts the tar stream diff onto id's diff directory, while
+// teeing it through a tar-split packer so that Diff can later reproduce
+// the exact same stream byte-for-byte instead of re-deriving one from
+// whatever ends up on disk.
+func (a *AufsDriver) ApplyDiff(id string, diff io.Reader) (int64, error) {
+	diffPath := path.Join(a.rootPath(), "diff", id)
+
+	f, err := os.Create(a.tarSplitPath(id))
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	gz := gzip.NewWriter(f)
+	defer gz.Close()
+
+	packer := storage.NewJSONPacker(gz)
+	tarStream, err := asm.NewInputTarStream(diff, packer, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	size, err := archive.UnpackLayer(diffPath, tarStream, nil)
+	if err != nil {
+		return 0, err
+	}
+	// UnpackLayer stops at the end-of-archive marker; read the rest so the
+	// packer has recorded the trailing bytes before gz is closed.
+	if _, err := io.Copy(io.Discard, tarStream); err != nil {
+		return 0, err
+	}
+	return size, nil
+}
+
+// Diff returns an archive of the changes made to id's diff directory. If
+// id was populated via ApplyDiff, the stream is reassembled from the
+// recorded tar-split metadata and is byte-identical to what was applied;
+// otherwise it falls back to tarring up the diff directory directly.
+func (a *AufsDriver) Diff(id string) (io.ReadCloser, error) {
+	diffPath := path.Join(a.rootPath(), "diff", id)
+
+	f, err := os.Open(a.tarSplitPath(id))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return archive.TarWithOptions(diffPath, &archive.TarOptions{})
+		}
+		return nil, err
+	}
+
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	unpacker := storage.NewJSONUnpacker(gz)
+	fileGetter := storage.NewPathFileGetter(diffPath)
+	tarStream := asm.NewOutputTarStream(fileGetter, unpacker)
+
+	return &tarSplitReadCloser{Reader: tarStream, f: f}, nil
+}
+
+// tarSplitReadCloser closes the underlying tar-split metadata file when
+// the reassembled tar stream is closed.
+type tarSplitReadCloser struct {
+	io.Reader
+	f *os.File
+}
+
+func (t *tarSplitReadCloser) Close() error {
+	return t.f.Close()
+}
+
+// DiffSize sums the payload sizes recorded in id's tar-split metadata,
+// without walking its diff directory.
+func (a *AufsDriver) DiffSize(id string) (int64, error) {
+	f, err := os.Open(a.tarSplitPath(id))
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return 0, err
+	}
+	defer gz.Close()
+
+	unpacker := storage.NewJSONUnpacker(gz)
+	var size int64
+	for {
+		entry, err := unpacker.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, err
+		}
+		if entry.Type == storage.FileType {
+			size += entry.Size
+		}
+	}
+	return size, nil
+}
@@ -0,0 +1,275 @@
+//go:build linux
+// +build linux
+
+package aufs
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// Project quotas let Create honor a StorageOpt "size" limit by assigning
+// the layer's diff directory a unique XFS/ext4 project id and setting a
+// hard block quota on it via FS_IOC_FSSETXATTR + quotactl(Q_XSETQLIM).
+// This requires the backing filesystem to be mounted with project quotas
+// enabled (xfs: pquota/prjquota, ext4: prjquota).
+const (
+	// from <linux/fs.h>
+	fsIocFsGetXattr    = 0x801c581f
+	fsIocFsSetXattr    = 0x401c5820
+	fsXflagProjInherit = 0x00000200
+
+	// from <linux/dqblk_xfs.h>
+	qXSetQLim    = 0x5804 // XQM_CMD(4): subcmd SETQLIM on the XFS quota format
+	xfsProjQuota = 2
+)
+
+// qcmd composes a quotactl cmd argument from a subcommand and quota type,
+// the same way <sys/quota.h>'s QCMD(cmd, type) macro does: QCMD(cmd, type)
+// == (cmd << 8) | type.
+func qcmd(cmd, typ int) int {
+	return (cmd << 8) | typ
+}
+
+type fsXattr struct {
+	fsxXflags     uint32
+	fsxExtsize    uint32
+	fsxNextents   uint32
+	fsxProjid     uint32
+	fsxCowextsize uint32
+	fsxPad        [8]byte
+}
+
+// fsDiskQuota mirrors the full layout of struct fs_disk_quota from
+// <linux/dqblk_xfs.h>; setProjectQuota only sets a few of its fields.
+type fsDiskQuota struct {
+	dVersion      int8
+	dFlags        int8
+	dFieldmask    uint16
+	dId           uint32
+	dBlkHardlimit uint64
+	dBlkSoftlimit uint64
+	dInoHardlimit uint64
+	dInoSoftlimit uint64
+	dBcount       uint64
+	dIcount       uint64
+	dItimer       int32
+	dBtimer       int32
+	dIwarns       uint16
+	dBwarns       uint16
+	dPadding2     int32
+	dRtbHardlimit uint64
+	dRtbSoftlimit uint64
+	dRtbcount     uint64
+	dRtbtimer     int32
+	dRtbwarns     uint16
+	dPadding3     int16
+	dPadding4     [8]byte
+}
+
+const (
+	fieldmaskBHard = 1 << 3
+)
+
+var (
+	// ErrQuotaNotSupported is returned by applyStorageOpt when the
+	// backing filesystem of the graph root does not support project
+	// quotas.
+	ErrQuotaNotSupported = fmt.Errorf("--storage-opt size is not supported on this filesystem")
+
+	projectIDLock sync.Mutex
+	nextProjectID uint32 = 1
+)
+
+// applyStorageOpt enforces opts["size"], if present, as a hard quota on
+// dir by assigning it a fresh XFS/ext4 project id. The allocated id is
+// returned so the caller can persist it alongside the rest of the
+// layer's metadata and release it again on Remove.
+func (a *AufsDriver) applyStorageOpt(dir string, opts map[string]string) (uint32, error) {
+	sizeStr, ok := opts["size"]
+	if !ok {
+		return 0, nil
+	}
+
+	size, err := parseStorageOptSize(sizeStr)
+	if err != nil {
+		return 0, err
+	}
+
+	projectID := allocProjectID()
+	if err := setProjectID(dir, projectID); err != nil {
+		return 0, ErrQuotaNotSupported
+	}
+	if err := setProjectQuota(dir, projectID, size); err != nil {
+		return 0, ErrQuotaNotSupported
+	}
+	return projectID, nil
+}
+
+func allocProjectID() uint32 {
+	projectIDLock.Lock()
+	defer projectIDLock.Unlock()
+	id := nextProjectID
+	nextProjectID++
+	return id
+}
+
+// seedProjectIDs scans layersDir for the "<id>-quota" files that
+// setProjectID persists per-layer and advances nextProjectID past the
+// highest one found, so that project ids still held by existing layers
+// are never handed out again to a different layer after a daemon restart.
+func seedProjectIDs(layersDir string) error {
+	entries, err := os.ReadDir(layersDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	var max uint32
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasSuffix(name, "-quota") {
+			continue
+		}
+		data, err := os.ReadFile(path.Join(layersDir, name))
+		if err != nil {
+			continue
+		}
+		var id uint32
+		if _, err := fmt.Sscanf(string(data), "%d", &id); err != nil {
+			continue
+		}
+		if id > max {
+			max = id
+		}
+	}
+
+	projectIDLock.Lock()
+	defer projectIDLock.Unlock()
+	if max+1 > nextProjectID {
+		nextProjectID = max + 1
+	}
+	return nil
+}
+
+// setProjectID tags dir with projectID via FS_IOC_FSSETXATTR, setting
+// FS_XFLAG_PROJINHERIT so files created under dir inherit the project id.
+func setProjectID(dir string, projectID uint32) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var attr fsXattr
+	if _, _, errno := unix.Syscall(unix.SYS_IOCTL, f.Fd(), fsIocFsGetXattr, uintptr(unsafe.Pointer(&attr))); errno != 0 {
+		return errno
+	}
+
+	attr.fsxProjid = projectID
+	attr.fsxXflags |= fsXflagProjInherit
+
+	if _, _, errno := unix.Syscall(unix.SYS_IOCTL, f.Fd(), fsIocFsSetXattr, uintptr(unsafe.Pointer(&attr))); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// setProjectQuota sets a hard block limit of size bytes for projectID on
+// the filesystem backing dir via quotactl(Q_XSETQLIM, ...).
+func setProjectQuota(dir string, projectID uint32, size uint64) error {
+	var stat unix.Statfs_t
+	if err := unix.Statfs(dir, &stat); err != nil {
+		return err
+	}
+
+	dq := fsDiskQuota{
+		dVersion:      1,
+		dId:           projectID,
+		dFlags:        xfsProjQuota,
+		dFieldmask:    fieldmaskBHard,
+		dBlkHardlimit: size / 512,
+	}
+
+	dev, err := mountDevice(dir)
+	if err != nil {
+		return err
+	}
+
+	cmd := qcmd(qXSetQLim, xfsProjQuota)
+	if _, _, errno := unix.Syscall6(unix.SYS_QUOTACTL, uintptr(cmd), uintptr(unsafe.Pointer(devPtr(dev))), uintptr(projectID), uintptr(unsafe.Pointer(&dq)), 0, 0); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// releaseProjectQuota zeroes out the quota for projectID, freeing it for
+// reuse once the layer that held it has been removed.
+func releaseProjectQuota(dir string, projectID uint32) error {
+	return setProjectQuota(dir, projectID, 0)
+}
+
+func devPtr(dev string) *byte {
+	b := append([]byte(dev), 0)
+	return &b[0]
+}
+
+// mountDevice resolves dir to the block device backing the filesystem it
+// lives on, by walking /proc/self/mountinfo for the longest mount point
+// that prefixes dir. quotactl(Q_XSETQLIM) takes this device, not dir
+// itself, as its special-file argument.
+func mountDevice(dir string) (string, error) {
+	f, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	var bestMountPoint, bestSource string
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		sep := -1
+		for i, field := range fields {
+			if field == "-" {
+				sep = i
+				break
+			}
+		}
+		if sep == -1 || sep+2 >= len(fields) {
+			continue
+		}
+
+		mountPoint, source := fields[4], fields[sep+2]
+		if mountPoint != dir && !strings.HasPrefix(dir, mountPoint+"/") {
+			continue
+		}
+		if len(mountPoint) > len(bestMountPoint) {
+			bestMountPoint, bestSource = mountPoint, source
+		}
+	}
+	if err := s.Err(); err != nil {
+		return "", err
+	}
+	if bestSource == "" {
+		return "", fmt.Errorf("could not resolve backing device for %s", dir)
+	}
+	return bestSource, nil
+}
+
+func parseStorageOptSize(s string) (uint64, error) {
+	var size uint64
+	if _, err := fmt.Sscanf(s, "%d", &size); err != nil {
+		return 0, fmt.Errorf("invalid size %q: %v", s, err)
+	}
+	return size, nil
+}
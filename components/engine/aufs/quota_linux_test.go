@@ -0,0 +1,53 @@
+//go:build linux
+// +build linux
+
+package aufs
+
+import (
+	"os"
+	"path"
+	"testing"
+)
+
+// TestQXSetQLimCmd guards against qXSetQLim regressing back to the raw
+// subcommand value: quotactl requires cmd to be QCMD(subcmd, type)-composed,
+// and a bare subcommand like 0x5804 silently turns into a no-op EINVAL on
+// every call since Q_XSETQLIM must be combined with PRJQUOTA.
+func TestQXSetQLimCmd(t *testing.T) {
+	if got, want := qcmd(qXSetQLim, xfsProjQuota), 0x580402; got != want {
+		t.Fatalf("qcmd(qXSetQLim, xfsProjQuota) = %#x, want %#x", got, want)
+	}
+}
+
+// TestCreateWithSizeEnforcesQuota requires tmp to live on an xfs or ext4
+// filesystem mounted with project quotas enabled (pquota/prjquota); it is
+// skipped unless DOCKER_TEST_AUFS_QUOTA is set, since most CI and developer
+// machines don't have one set up.
+func TestCreateWithSizeEnforcesQuota(t *testing.T) {
+	if os.Getenv("DOCKER_TEST_AUFS_QUOTA") == "" {
+		t.Skip("set DOCKER_TEST_AUFS_QUOTA=1 on a host with an xfs/ext4 project-quota mount to run this test")
+	}
+
+	d := newDriver(t)
+	defer os.RemoveAll(tmp)
+
+	const limit = 1024 * 1024 // 1MiB
+	if err := d.Create("1", "", map[string]string{"size": "1048576"}); err != nil {
+		t.Fatal(err)
+	}
+
+	mnt, err := d.Get("1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Create(path.Join(mnt.Path(), "test_file"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	if _, err := f.Write(make([]byte, limit*2)); err == nil {
+		t.Fatal("Expected writing past the layer's quota to fail with ENOSPC")
+	}
+}
@@ -0,0 +1,26 @@
+//go:build !linux
+// +build !linux
+
+package aufs
+
+import "fmt"
+
+// ErrQuotaNotSupported is returned by applyStorageOpt on platforms where
+// aufs itself is not supported, and therefore neither is project-quota
+// enforcement of StorageOpt "size".
+var ErrQuotaNotSupported = fmt.Errorf("--storage-opt size is not supported on this filesystem")
+
+func (a *AufsDriver) applyStorageOpt(dir string, opts map[string]string) (uint32, error) {
+	if _, ok := opts["size"]; ok {
+		return 0, ErrQuotaNotSupported
+	}
+	return 0, nil
+}
+
+func releaseProjectQuota(dir string, projectID uint32) error {
+	return nil
+}
+
+func seedProjectIDs(layersDir string) error {
+	return nil
+}